@@ -11,6 +11,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"runtime"
+	"sync"
 	"syscall"
 	"unsafe"
 )
@@ -19,23 +21,119 @@ const (
 	i2cSlave      = 0x0703
 	i2cSlaveForce = 0x0706
 	i2cFuncs      = 0x0705
+	i2cRdwr       = 0x0707
+	i2cPec        = 0x0708
 	i2cSMBus      = 0x0720
 
 	i2cSMBusWrite uint8 = 0
 	i2cSMBusRead  uint8 = 1
 
 	// size identifiers
-	i2cSMBusByteData     uint32 = 2
-	i2cSMBusWordData     uint32 = 3
-	i2cSMBusBlockData    uint32 = 5
-	i2cSMBusI2CBlockData uint32 = 8
-	i2cSMBusBlockMax     uint32 = 32
+	i2cSMBusByteData      uint32 = 2
+	i2cSMBusWordData      uint32 = 3
+	i2cSMBusProcCall      uint32 = 4
+	i2cSMBusBlockData     uint32 = 5
+	i2cSMBusBlockProcCall uint32 = 7
+	i2cSMBusI2CBlockData  uint32 = 8
+	i2cSMBusBlockMax      uint32 = 32
 )
 
+// Msg flags, as defined by linux/i2c.h.
+const (
+	// MsgRead marks a message as a read from the device. The absence of
+	// this flag means the message is a write.
+	MsgRead uint16 = 0x0001
+	// MsgTenBitAddr marks Msg.Addr as a 10-bit address rather than the
+	// usual 7-bit one.
+	MsgTenBitAddr uint16 = 0x0010
+	// MsgNoStart folds this message into the previous one, omitting the
+	// repeated START and the slave address that would normally begin it.
+	MsgNoStart uint16 = 0x4000
+	// MsgRecvLen indicates the first byte received is a length byte and
+	// the real payload follows it, per the SMBus block read convention.
+	MsgRecvLen uint16 = 0x0400
+)
+
+// Msg is a single segment of a combined I2C_RDWR transaction: either a
+// write of Buf to the device at Addr, or a read of len(Buf) bytes from it,
+// depending on whether Flags has MsgRead set.
+type Msg struct {
+	Addr  uint16
+	Flags uint16
+	Buf   []byte
+}
+
 var (
 	errSMBusBlockDataMax = errors.New("smbus: buffer slice too big")
+
+	// ErrUnsupported is returned in place of the raw EOPNOTSUPP errno when
+	// the adapter does not implement the requested transaction. Callers
+	// can check for it (e.g. with errors.Is) to fall back to another
+	// access method instead of failing outright.
+	ErrUnsupported = errors.New("smbus: operation not supported by adapter")
+
+	// ErrPEC is returned when a transaction's trailing SMBus Packet Error
+	// Checking byte does not match the CRC-8 computed over the
+	// transaction, indicating corrupted data on the bus.
+	ErrPEC = errors.New("smbus: PEC checksum mismatch")
+)
+
+// crc8 computes the SMBus PEC checksum: a CRC-8 with polynomial x^8 + x^2
+// + x + 1 (0x07), initial value 0, over data.
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// Funcs is a bitfield of I2C/SMBus transaction types an adapter supports,
+// as reported by the I2C_FUNCS ioctl.
+type Funcs uint64
+
+// Adapter functionality bits, as defined by linux/i2c.h.
+const (
+	FuncI2C                 Funcs = 0x00000001
+	Func10BitAddr           Funcs = 0x00000002
+	FuncProtocolMangling    Funcs = 0x00000004
+	FuncSMBusPEC            Funcs = 0x00000008
+	FuncNoStart             Funcs = 0x00000010
+	FuncSlave               Funcs = 0x00000020
+	FuncSMBusBlockProcCall  Funcs = 0x00008000
+	FuncSMBusQuick          Funcs = 0x00010000
+	FuncSMBusReadByte       Funcs = 0x00020000
+	FuncSMBusWriteByte      Funcs = 0x00040000
+	FuncSMBusReadByteData   Funcs = 0x00080000
+	FuncSMBusWriteByteData  Funcs = 0x00100000
+	FuncSMBusReadWordData   Funcs = 0x00200000
+	FuncSMBusWriteWordData  Funcs = 0x00400000
+	FuncSMBusProcCall       Funcs = 0x00800000
+	FuncSMBusReadBlockData  Funcs = 0x01000000
+	FuncSMBusWriteBlockData Funcs = 0x02000000
+	FuncSMBusReadI2CBlock   Funcs = 0x04000000
+	FuncSMBusWriteI2CBlock  Funcs = 0x08000000
+	FuncSMBusHostNotify     Funcs = 0x10000000
+
+	FuncSMBusByte      = FuncSMBusReadByte | FuncSMBusWriteByte
+	FuncSMBusByteData  = FuncSMBusReadByteData | FuncSMBusWriteByteData
+	FuncSMBusWordData  = FuncSMBusReadWordData | FuncSMBusWriteWordData
+	FuncSMBusBlockData = FuncSMBusReadBlockData | FuncSMBusWriteBlockData
+	FuncSMBusI2CBlock  = FuncSMBusReadI2CBlock | FuncSMBusWriteI2CBlock
 )
 
+// Has reports whether all the bits set in want are also set in f.
+func (f Funcs) Has(want Funcs) bool {
+	return f&want == want
+}
+
 //Options defines I2C options
 type Options struct {
 	//Force if true, forces to open i2c even if address is taken by Linux driver
@@ -47,10 +145,15 @@ type Options struct {
 
 // Conn is connection to a i2c device.
 type Conn struct {
+	mu         sync.Mutex
 	f          *os.File
+	bus        int
 	force      bool
 	backupRegs map[uint8]uint8
 	backupaddr uint8
+	swPEC      bool
+	lastAddr   uint8
+	addrValid  bool
 }
 
 // OpenFileWithOptions opens a connection with options to the i2c bus number
@@ -68,6 +171,7 @@ func OpenFileWithOptions(bus int, opts *Options) (*Conn, error) {
 		return nil, err
 	}
 	return &Conn{f: f,
+		bus:        bus,
 		force:      opts.Force,
 		backupRegs: map[uint8]uint8{},
 		backupaddr: 0}, nil
@@ -99,7 +203,7 @@ func OpenWithOptions(bus int, addr uint8, opts *Options) (c *Conn, err error) {
 		return
 	}
 
-	if err = c.addr(addr); err != nil {
+	if err = c.SetAddr(addr); err != nil {
 		c.Close()
 		c = nil
 		return
@@ -164,6 +268,9 @@ func (c *Conn) Close() error {
 
 // ReadReg reads a single byte from a designated register.
 func (c *Conn) ReadReg(addr, reg uint8) (uint8, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if err := c.addr(addr); err != nil {
 		return 0, err
 	}
@@ -182,6 +289,9 @@ func (c *Conn) ReadReg(addr, reg uint8) (uint8, error) {
 
 // WriteReg writes a single byte v to a designated register.
 func (c *Conn) WriteReg(addr, reg, v uint8) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if err := c.addr(addr); err != nil {
 		return err
 	}
@@ -198,6 +308,13 @@ func (c *Conn) WriteReg(addr, reg, v uint8) error {
 
 // ReadWord reads a 2-bytes word from a designated register.
 func (c *Conn) ReadWord(addr, reg uint8) (uint16, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.swPEC {
+		return c.readWordPEC(addr, reg)
+	}
+
 	if err := c.addr(addr); err != nil {
 		return 0, err
 	}
@@ -214,8 +331,34 @@ func (c *Conn) ReadWord(addr, reg uint8) (uint16, error) {
 	return v, err
 }
 
+// readWordPEC performs a word read as a raw I2C_RDWR transaction, checking
+// the trailing byte against the CRC-8 computed in software.
+func (c *Conn) readWordPEC(addr, reg uint8) (uint16, error) {
+	data := make([]byte, 3)
+	msgs := []Msg{
+		{Addr: uint16(addr), Buf: []byte{reg}},
+		{Addr: uint16(addr), Flags: MsgRead, Buf: data},
+	}
+	if err := c.transfer(msgs); err != nil {
+		return 0, err
+	}
+
+	want := crc8([]byte{addr << 1, reg, addr<<1 | 1, data[0], data[1]})
+	if want != data[2] {
+		return 0, ErrPEC
+	}
+	return uint16(data[0]) | uint16(data[1])<<8, nil
+}
+
 // WriteWord writes a 2-bytes word v to a designated register.
 func (c *Conn) WriteWord(addr, reg uint8, v uint16) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.swPEC {
+		return c.writeWordPEC(addr, reg, v)
+	}
+
 	if err := c.addr(addr); err != nil {
 		return err
 	}
@@ -230,12 +373,28 @@ func (c *Conn) WriteWord(addr, reg uint8, v uint16) error {
 	return ioctl(c.f.Fd(), i2cSMBus, uintptr(ptr))
 }
 
+// writeWordPEC performs a word write as a raw I2C_RDWR transaction, with a
+// trailing CRC-8 byte computed in software appended after the data.
+func (c *Conn) writeWordPEC(addr, reg uint8, v uint16) error {
+	data := []byte{reg, byte(v), byte(v >> 8)}
+	crc := crc8(append([]byte{addr << 1}, data...))
+	data = append(data, crc)
+	return c.transfer([]Msg{{Addr: uint16(addr), Buf: data}})
+}
+
 // ReadBlockData reads len(buf) data into the byte slice, from the designated register.
 func (c *Conn) ReadBlockData(addr, reg uint8, buf []byte) error {
 	if len(buf) > int(i2cSMBusBlockMax) {
 		return errSMBusBlockDataMax
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.swPEC {
+		return c.readBlockDataPEC(addr, reg, buf)
+	}
+
 	if err := c.addr(addr); err != nil {
 		return err
 	}
@@ -258,12 +417,39 @@ func (c *Conn) ReadBlockData(addr, reg uint8, buf []byte) error {
 	return nil
 }
 
+// readBlockDataPEC performs a block read as a raw I2C_RDWR transaction,
+// checking the trailing byte against the CRC-8 computed in software.
+func (c *Conn) readBlockDataPEC(addr, reg uint8, buf []byte) error {
+	data := make([]byte, len(buf)+1)
+	msgs := []Msg{
+		{Addr: uint16(addr), Buf: []byte{reg}},
+		{Addr: uint16(addr), Flags: MsgRead, Buf: data},
+	}
+	if err := c.transfer(msgs); err != nil {
+		return err
+	}
+
+	want := crc8(append([]byte{addr << 1, reg, addr<<1 | 1}, data[:len(buf)]...))
+	if want != data[len(buf)] {
+		return ErrPEC
+	}
+	copy(buf, data[:len(buf)])
+	return nil
+}
+
 // WriteBlockData writes the buf byte slice to a designated register.
 func (c *Conn) WriteBlockData(addr, reg uint8, buf []byte) error {
 	if len(buf) > int(i2cSMBusBlockMax) {
 		return errSMBusBlockDataMax
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.swPEC {
+		return c.writeBlockDataPEC(addr, reg, buf)
+	}
+
 	if err := c.addr(addr); err != nil {
 		return err
 	}
@@ -282,20 +468,220 @@ func (c *Conn) WriteBlockData(addr, reg uint8, buf []byte) error {
 	return ioctl(c.f.Fd(), i2cSMBus, uintptr(ptr))
 }
 
+// writeBlockDataPEC performs a block write as a raw I2C_RDWR transaction,
+// with a trailing CRC-8 byte computed in software appended after the data.
+func (c *Conn) writeBlockDataPEC(addr, reg uint8, buf []byte) error {
+	data := append([]byte{reg}, buf...)
+	crc := crc8(append([]byte{addr << 1}, data...))
+	data = append(data, crc)
+	return c.transfer([]Msg{{Addr: uint16(addr), Buf: data}})
+}
+
+// ProcessCall writes v to a designated register and, within the same
+// repeated-start transaction, reads back the word the device responds
+// with. This is the SMBus Process Call transaction type, used e.g. by
+// smart-battery commands that compute a reply from the written value.
+func (c *Conn) ProcessCall(addr, reg uint8, v uint16) (uint16, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.addr(addr); err != nil {
+		return 0, err
+	}
+
+	data := v
+	cmd := i2cCmd{
+		rw:  i2cSMBusWrite,
+		cmd: reg,
+		len: i2cSMBusProcCall,
+		ptr: unsafe.Pointer(&data),
+	}
+	ptr := unsafe.Pointer(&cmd)
+	err := ioctl(c.f.Fd(), i2cSMBus, uintptr(ptr))
+	return data, err
+}
+
+// BlockProcessCall writes out to a designated register and, within the
+// same repeated-start transaction, reads back a variable-length block the
+// device responds with. This is the SMBus Block Write-Block Read Process
+// Call, used e.g. to query SFF-8472 SFP module diagnostic memory maps.
+func (c *Conn) BlockProcessCall(addr, reg uint8, out []byte) ([]byte, error) {
+	if len(out) > int(i2cSMBusBlockMax) {
+		return nil, errSMBusBlockDataMax
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.addr(addr); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 1+len(out), i2cSMBusBlockMax+2)
+	data[0] = byte(len(out))
+	copy(data[1:], out)
+
+	cmd := i2cCmd{
+		rw:  i2cSMBusWrite,
+		cmd: reg,
+		len: i2cSMBusBlockProcCall,
+		ptr: unsafe.Pointer(&data[0]),
+	}
+	ptr := unsafe.Pointer(&cmd)
+	if err := ioctl(c.f.Fd(), i2cSMBus, uintptr(ptr)); err != nil {
+		return nil, err
+	}
+
+	n := int(data[0])
+	result := make([]byte, n)
+	copy(result, data[1:1+n])
+	return result, nil
+}
+
+// Transfer performs a combined I2C_RDWR transaction: all msgs are carried
+// out back-to-back within a single repeated-start bus operation, each one
+// addressing its own device and direction. This allows mixed read/write
+// sequences (e.g. writing a register pointer then reading a variable
+// length payload) that the SMBus ioctls used by ReadBlockData and friends
+// cannot express.
+//
+// Transfer bypasses the cached slave address set by SetAddr: each Msg
+// carries its own address, as the kernel expects.
+func (c *Conn) Transfer(msgs []Msg) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.transfer(msgs)
+}
+
+// transfer is the unlocked implementation of Transfer, reused internally
+// by the software PEC fallback so it doesn't recursively lock c.mu.
+// Callers must hold c.mu.
+func (c *Conn) transfer(msgs []Msg) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	kmsgs := make([]i2cMsg, len(msgs))
+	for i, m := range msgs {
+		kmsgs[i] = i2cMsg{
+			addr:  m.Addr,
+			flags: m.Flags,
+			len:   uint16(len(m.Buf)),
+		}
+		if len(m.Buf) > 0 {
+			kmsgs[i].buf = unsafe.Pointer(&m.Buf[0])
+		}
+	}
+
+	data := i2cRdwrIoctlData{
+		msgs:  unsafe.Pointer(&kmsgs[0]),
+		nmsgs: uint32(len(kmsgs)),
+	}
+	err := ioctl(c.f.Fd(), i2cRdwr, uintptr(unsafe.Pointer(&data)))
+	// Keep the message buffers (and the kmsgs backing array holding their
+	// pointers) alive until the ioctl has returned.
+	runtime.KeepAlive(kmsgs)
+	runtime.KeepAlive(msgs)
+	return err
+}
+
+// speedSetter holds the board-specific callback registered via
+// RegisterSpeedSetter, if any.
+var speedSetter func(bus int, hz uint32) error
+
+// RegisterSpeedSetter installs f as the implementation used by
+// (*Conn).SetBusSpeed. Linux has no standard ioctl for changing the I2C
+// clock frequency, so platform packages (Raspberry Pi, i.MX, ...) that
+// know how to reach the board's clock divider register this hook, e.g.
+// from an init function, before any Conn.SetBusSpeed call is made.
+func RegisterSpeedSetter(f func(bus int, hz uint32) error) {
+	speedSetter = f
+}
+
+// SetBusSpeed sets the i2c bus clock to hz, using the setter installed
+// with RegisterSpeedSetter. It returns ErrUnsupported if no setter has
+// been registered for this platform.
+func (c *Conn) SetBusSpeed(hz uint32) error {
+	if speedSetter == nil {
+		return ErrUnsupported
+	}
+	return speedSetter(c.bus, hz)
+}
+
+// SetPEC enables or disables SMBus Packet Error Checking on this
+// connection. It first tries the I2C_PEC ioctl so the kernel generates
+// and verifies the CRC-8 itself; if the adapter doesn't support that,
+// ReadBlockData, WriteBlockData, ReadWord and WriteWord fall back to
+// computing and checking the PEC byte in software.
+func (c *Conn) SetPEC(enable bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var v uintptr
+	if enable {
+		v = 1
+	}
+	err := ioctl(c.f.Fd(), i2cPec, v)
+	if err == nil {
+		c.swPEC = false
+		return nil
+	}
+	if err == ErrUnsupported {
+		c.swPEC = enable
+		return nil
+	}
+	return err
+}
+
+// Funcs queries the adapter for the set of I2C/SMBus transactions it
+// implements, via the I2C_FUNCS ioctl. Drivers can use it to check for a
+// capability before relying on it, and fall back cleanly on adapters that
+// emulate only a subset of SMBus (e.g. lacking PEC or 10-bit addressing).
+func (c *Conn) Funcs() (Funcs, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var f uint64
+	err := ioctl(c.f.Fd(), i2cFuncs, uintptr(unsafe.Pointer(&f)))
+	return Funcs(f), err
+}
+
+// addr issues the I2C_SLAVE(_FORCE) ioctl to select addr as the target
+// device, unless addr is already the cached lastAddr from a previous call.
+// Callers must hold c.mu.
 func (c *Conn) addr(addr uint8) error {
+	if c.addrValid && c.lastAddr == addr {
+		return nil
+	}
+
+	var err error
 	if c.force {
-		return ioctl(c.f.Fd(), i2cSlaveForce, uintptr(addr))
+		err = ioctl(c.f.Fd(), i2cSlaveForce, uintptr(addr))
 	} else {
-		return ioctl(c.f.Fd(), i2cSlave, uintptr(addr))
+		err = ioctl(c.f.Fd(), i2cSlave, uintptr(addr))
+	}
+	if err != nil {
+		c.addrValid = false
+		return err
 	}
+
+	c.lastAddr = addr
+	c.addrValid = true
+	return nil
 }
 
+// SetAddr sets the slave address used for subsequent transactions.
 func (c *Conn) SetAddr(addr uint8) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.addr(addr)
 }
 
 func ioctl(fd, cmd, arg uintptr) (err error) {
 	_, _, e1 := syscall.Syscall6(syscall.SYS_IOCTL, fd, cmd, arg, 0, 0, 0)
+	if e1 == syscall.EOPNOTSUPP {
+		return ErrUnsupported
+	}
 	if e1 != 0 {
 		err = e1
 	}
@@ -308,3 +694,17 @@ type i2cCmd struct {
 	len uint32
 	ptr unsafe.Pointer
 }
+
+// i2cMsg mirrors struct i2c_msg from linux/i2c.h.
+type i2cMsg struct {
+	addr  uint16
+	flags uint16
+	len   uint16
+	buf   unsafe.Pointer
+}
+
+// i2cRdwrIoctlData mirrors struct i2c_rdwr_ioctl_data from linux/i2c-dev.h.
+type i2cRdwrIoctlData struct {
+	msgs  unsafe.Pointer
+	nmsgs uint32
+}